@@ -0,0 +1,302 @@
+package kcl
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// kplMagicNumber prefixes every KPL-aggregated Kinesis record, so a consumer
+// can tell an aggregated record apart from a plain one before attempting to
+// parse it. See https://github.com/awslabs/amazon-kinesis-producer/blob/master/aggregation-format.md.
+var kplMagicNumber = []byte{0xF3, 0x89, 0x9A, 0xC2}
+
+// aggregatedRecordOverhead is how many bytes aggregate adds on top of the
+// protobuf-encoded AggregatedRecord payload: the 4-byte KPL magic header and
+// the trailing MD5 checksum. Producer accounts for this when deciding how
+// much payload it can buffer before a Kinesis record would come out over
+// Kinesis's 1 MB record size limit.
+const aggregatedRecordOverhead = 4 + md5.Size
+
+// aggregatedUserRecord is one user record packed inside an AggregatedRecord,
+// referencing its partition key by index into the enclosing partition key
+// table rather than repeating the string.
+type aggregatedUserRecord struct {
+	partitionKeyIndex int
+	data              []byte
+}
+
+// encodeAggregatedRecord protobuf-encodes the AggregatedRecord message: a
+// partition key table and the records themselves. It deliberately never
+// emits field 2, explicit_hash_key_table, or field 2 of Record,
+// explicit_hash_key_index: we always pin a whole aggregated record to a
+// shard via the outer PutRecordsRequestEntry.ExplicitHashKey instead of
+// per-user-record hash keys, so the table would always be empty and every
+// Record's index into it unused. AggregatedRecordDecoder doesn't read
+// either field for the same reason, and standard KPL deaggregators fall
+// back to partition_key_table when explicit_hash_key_table is absent, so
+// this is safe to decode elsewhere too.
+//
+//	message AggregatedRecord {
+//	  repeated string partition_key_table = 1;
+//	  repeated string explicit_hash_key_table = 2;
+//	  repeated Record records = 3;
+//	}
+//	message Record {
+//	  optional uint64 partition_key_index = 1;
+//	  optional uint64 explicit_hash_key_index = 2;
+//	  required bytes data = 3;
+//	}
+func encodeAggregatedRecord(partitionKeyTable []string, records []aggregatedUserRecord) []byte {
+	var buf []byte
+	for _, pk := range partitionKeyTable {
+		buf = appendStringField(buf, 1, pk)
+	}
+	for _, r := range records {
+		buf = appendBytesField(buf, 3, encodeRecord(r))
+	}
+	return buf
+}
+
+// encodeRecord protobuf-encodes a single Record message within an
+// AggregatedRecord.
+func encodeRecord(r aggregatedUserRecord) []byte {
+	var buf []byte
+	buf = appendVarintField(buf, 1, uint64(r.partitionKeyIndex))
+	buf = appendBytesField(buf, 3, r.data)
+	return buf
+}
+
+// aggregate wraps a protobuf-encoded AggregatedRecord payload with the KPL
+// magic header and an MD5 checksum trailer, producing the bytes that go
+// directly into a Kinesis record's Data field.
+func aggregate(partitionKeyTable []string, records []aggregatedUserRecord) []byte {
+	payload := encodeAggregatedRecord(partitionKeyTable, records)
+	checksum := md5.Sum(payload)
+
+	out := make([]byte, 0, len(kplMagicNumber)+len(payload)+len(checksum))
+	out = append(out, kplMagicNumber...)
+	out = append(out, payload...)
+	out = append(out, checksum[:]...)
+	return out
+}
+
+// aggregator accumulates user records destined for a single shard until
+// Producer is ready to flush them as one aggregated Kinesis record.
+type aggregator struct {
+	partitionKeys     map[string]int
+	partitionKeyTable []string
+	records           []aggregatedUserRecord
+	size              int
+}
+
+// newAggregator returns an empty aggregator ready to accept records.
+func newAggregator() *aggregator {
+	return &aggregator{partitionKeys: make(map[string]int)}
+}
+
+// add appends a user record to the aggregator, reusing partitionKey's
+// existing table index if we have already seen it. size tracks the actual
+// protobuf-encoded payload size (the same bytes encode will produce), not
+// just the raw data and partition key lengths, since the protobuf framing
+// and repeated partition keys both add up across many small records.
+func (a *aggregator) add(partitionKey string, data []byte) {
+	index, ok := a.partitionKeys[partitionKey]
+	if !ok {
+		index = len(a.partitionKeyTable)
+		a.partitionKeyTable = append(a.partitionKeyTable, partitionKey)
+		a.partitionKeys[partitionKey] = index
+		a.size += len(appendStringField(nil, 1, partitionKey))
+	}
+
+	record := aggregatedUserRecord{partitionKeyIndex: index, data: data}
+	a.records = append(a.records, record)
+	a.size += len(appendBytesField(nil, 3, encodeRecord(record)))
+}
+
+// count returns how many user records are currently buffered.
+func (a *aggregator) count() int {
+	return len(a.records)
+}
+
+// encode renders the buffered records as a single KPL-aggregated Kinesis
+// record.
+func (a *aggregator) encode() []byte {
+	return aggregate(a.partitionKeyTable, a.records)
+}
+
+// decodedUserRecord is a single user record recovered from an
+// AggregatedRecord, with its partition key already resolved out of the
+// partition key table.
+type decodedUserRecord struct {
+	partitionKey string
+	data         []byte
+}
+
+// AggregatedRecordDecoder is a RecordTransformer that recognizes KPL
+// aggregated records by their magic header, verifies the MD5 checksum, and
+// fans the AggregatedRecord back out into one synthetic record per user
+// record it contains. Records that don't carry the magic header are passed
+// through unchanged, so it is safe to use against a stream with a mix of
+// aggregated and plain producers.
+//
+// Set it as Config.RecordTransformer to use it.
+func AggregatedRecordDecoder(record *kinesis.Record) ([]*kinesis.Record, error) {
+	if len(record.Data) < len(kplMagicNumber)+md5.Size || !bytes.Equal(record.Data[:len(kplMagicNumber)], kplMagicNumber) {
+		return []*kinesis.Record{record}, nil
+	}
+
+	payload := record.Data[len(kplMagicNumber) : len(record.Data)-md5.Size]
+	checksum := record.Data[len(record.Data)-md5.Size:]
+	if sum := md5.Sum(payload); !bytes.Equal(sum[:], checksum) {
+		return nil, fmt.Errorf("kcl: aggregated record failed md5 checksum")
+	}
+
+	decoded, err := decodeAggregatedRecord(payload)
+	if err != nil {
+		return nil, fmt.Errorf("kcl: decoding aggregated record: %v", err)
+	}
+
+	records := make([]*kinesis.Record, 0, len(decoded))
+	for _, d := range decoded {
+		records = append(records, &kinesis.Record{
+			Data:                        d.data,
+			PartitionKey:                aws.String(d.partitionKey),
+			SequenceNumber:              record.SequenceNumber,
+			ApproximateArrivalTimestamp: record.ApproximateArrivalTimestamp,
+		})
+	}
+
+	return records, nil
+}
+
+// decodeAggregatedRecord parses a protobuf-encoded AggregatedRecord payload
+// (magic header and checksum already stripped) back into user records.
+func decodeAggregatedRecord(payload []byte) ([]decodedUserRecord, error) {
+	fields, err := decodeProtobufFields(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var partitionKeyTable []string
+	for _, b := range fields[1] {
+		partitionKeyTable = append(partitionKeyTable, string(b))
+	}
+
+	var records []decodedUserRecord
+	for _, b := range fields[3] {
+		recordFields, err := decodeProtobufFields(b)
+		if err != nil {
+			return nil, err
+		}
+
+		var index uint64
+		if raw, ok := firstField(recordFields[1]); ok {
+			index, _ = binary.Uvarint(raw)
+		}
+
+		var data []byte
+		if raw, ok := firstField(recordFields[3]); ok {
+			data = raw
+		}
+
+		var partitionKey string
+		if int(index) < len(partitionKeyTable) {
+			partitionKey = partitionKeyTable[index]
+		}
+
+		records = append(records, decodedUserRecord{partitionKey: partitionKey, data: data})
+	}
+
+	return records, nil
+}
+
+// firstField returns the first raw value decoded for a field, since none of
+// the fields we read (partition_key_index, data) are ever repeated.
+func firstField(values [][]byte) ([]byte, bool) {
+	if len(values) == 0 {
+		return nil, false
+	}
+	return values[0], true
+}
+
+// decodeProtobufFields does a generic, schema-less pass over a protobuf
+// message, returning the raw bytes behind each field number it finds. For a
+// varint field this is the varint's own encoded bytes (still readable with
+// binary.Uvarint); for a length-delimited field it is the field's contents.
+// We only need to understand these two wire types for AggregatedRecord.
+func decodeProtobufFields(buf []byte) (map[int][][]byte, error) {
+	fields := make(map[int][][]byte)
+
+	for len(buf) > 0 {
+		tag, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, fmt.Errorf("kcl: invalid protobuf field tag")
+		}
+		buf = buf[n:]
+
+		field := int(tag >> 3)
+		wireType := int(tag & 0x7)
+
+		switch wireType {
+		case 0:
+			_, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return nil, fmt.Errorf("kcl: invalid protobuf varint")
+			}
+			fields[field] = append(fields[field], buf[:n])
+			buf = buf[n:]
+		case 2:
+			length, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return nil, fmt.Errorf("kcl: invalid protobuf length prefix")
+			}
+			buf = buf[n:]
+			if uint64(len(buf)) < length {
+				return nil, fmt.Errorf("kcl: truncated protobuf field")
+			}
+			fields[field] = append(fields[field], buf[:length])
+			buf = buf[length:]
+		default:
+			return nil, fmt.Errorf("kcl: unsupported protobuf wire type %d", wireType)
+		}
+	}
+
+	return fields, nil
+}
+
+// appendTag appends a protobuf field tag (field number and wire type).
+func appendTag(buf []byte, field, wireType int) []byte {
+	return appendUvarint(buf, uint64(field)<<3|uint64(wireType))
+}
+
+// appendUvarint appends v as a protobuf varint.
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// appendStringField appends a length-delimited string field.
+func appendStringField(buf []byte, field int, s string) []byte {
+	buf = appendTag(buf, field, 2)
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// appendBytesField appends a length-delimited bytes field.
+func appendBytesField(buf []byte, field int, b []byte) []byte {
+	buf = appendTag(buf, field, 2)
+	buf = appendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// appendVarintField appends a varint-encoded unsigned integer field.
+func appendVarintField(buf []byte, field int, v uint64) []byte {
+	buf = appendTag(buf, field, 0)
+	return appendUvarint(buf, v)
+}
@@ -0,0 +1,89 @@
+package kcl
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestAggregateRoundTrip(t *testing.T) {
+	agg := newAggregator()
+	agg.add("alice", []byte("hello"))
+	agg.add("bob", []byte("world"))
+	agg.add("alice", []byte("again"))
+
+	record := &kinesis.Record{
+		Data:           agg.encode(),
+		SequenceNumber: aws.String("1234"),
+	}
+
+	records, err := AggregatedRecordDecoder(record)
+	if err != nil {
+		t.Fatalf("AggregatedRecordDecoder: %v", err)
+	}
+
+	want := []struct {
+		partitionKey string
+		data         string
+	}{
+		{"alice", "hello"},
+		{"bob", "world"},
+		{"alice", "again"},
+	}
+
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d", len(records), len(want))
+	}
+
+	for i, w := range want {
+		if got := aws.StringValue(records[i].PartitionKey); got != w.partitionKey {
+			t.Errorf("record %d: partition key = %q, want %q", i, got, w.partitionKey)
+		}
+		if got := string(records[i].Data); got != w.data {
+			t.Errorf("record %d: data = %q, want %q", i, got, w.data)
+		}
+		if got := aws.StringValue(records[i].SequenceNumber); got != "1234" {
+			t.Errorf("record %d: sequence number = %q, want %q", i, got, "1234")
+		}
+	}
+}
+
+func TestAggregatedRecordDecoderPassesThroughPlainRecords(t *testing.T) {
+	record := &kinesis.Record{Data: []byte("just a plain record, no magic header")}
+
+	records, err := AggregatedRecordDecoder(record)
+	if err != nil {
+		t.Fatalf("AggregatedRecordDecoder: %v", err)
+	}
+
+	if len(records) != 1 || records[0] != record {
+		t.Fatalf("expected the plain record to be passed through unchanged")
+	}
+}
+
+func TestAggregatedRecordDecoderRejectsBadChecksum(t *testing.T) {
+	agg := newAggregator()
+	agg.add("alice", []byte("hello"))
+	data := agg.encode()
+
+	// Flip every bit of the first payload byte without updating the trailing
+	// MD5 checksum.
+	data[len(kplMagicNumber)] ^= 0xFF
+
+	if _, err := AggregatedRecordDecoder(&kinesis.Record{Data: data}); err == nil {
+		t.Fatal("expected an error for a corrupted aggregated record, got nil")
+	}
+}
+
+func TestDecodeProtobufFieldsRejectsTruncatedField(t *testing.T) {
+	// A length-delimited field (wire type 2) on field 1 claiming 10 bytes of
+	// content but only supplying 1.
+	buf := appendTag(nil, 1, 2)
+	buf = appendUvarint(buf, 10)
+	buf = append(buf, 'x')
+
+	if _, err := decodeProtobufFields(buf); err == nil {
+		t.Fatal("expected an error for a truncated protobuf field, got nil")
+	}
+}
@@ -33,8 +33,8 @@ func main() {
 	}
 }
 
-func handler(records []*kinesis.Record) {
+func handler(shardID string, records []*kinesis.Record) {
 	for _, r := range records {
-		fmt.Println(*r.SequenceNumber)
+		fmt.Println(shardID, *r.SequenceNumber)
 	}
 }
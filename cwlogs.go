@@ -0,0 +1,84 @@
+package kcl
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// RecordTransformer lets you rewrite the records Kinesis hands back from
+// GetRecords before they reach your HandlerFunc, for example to decode a
+// wire format like the CloudWatch Logs subscription payload into one record
+// per log event. Returning a nil slice drops the record.
+type RecordTransformer func(record *kinesis.Record) ([]*kinesis.Record, error)
+
+// cloudWatchLogsControlMessage is the messageType CloudWatch Logs uses for
+// periodic keep-alive records that carry no log events and should be
+// dropped rather than handed to the HandlerFunc.
+const cloudWatchLogsControlMessage = "CONTROL_MESSAGE"
+
+// cloudWatchLogsSubscription is the envelope CloudWatch Logs subscription
+// filters push onto a Kinesis stream: a gzip-compressed JSON document
+// describing one or more log events from a single log stream.
+type cloudWatchLogsSubscription struct {
+	MessageType string                `json:"messageType"`
+	Owner       string                `json:"owner"`
+	LogGroup    string                `json:"logGroup"`
+	LogStream   string                `json:"logStream"`
+	LogEvents   []cloudWatchLogsEvent `json:"logEvents"`
+}
+
+// cloudWatchLogsEvent is a single log line within a subscription envelope.
+type cloudWatchLogsEvent struct {
+	ID        string `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+	Message   string `json:"message"`
+}
+
+// CloudWatchLogsDecoder is a RecordTransformer that recognizes CloudWatch
+// Logs subscription records: it gunzips Record.Data, unmarshals the
+// subscription envelope, drops CONTROL_MESSAGE records, and fans each of the
+// remaining logEvents out as its own synthetic record. The source logGroup
+// and logStream are preserved on the synthetic record's PartitionKey as
+// "logGroup/logStream", since HandlerFunc only sees *kinesis.Record values.
+//
+// Set it as Config.RecordTransformer to use it.
+func CloudWatchLogsDecoder(record *kinesis.Record) ([]*kinesis.Record, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(record.Data))
+	if err != nil {
+		return nil, fmt.Errorf("kcl: decompressing cloudwatch logs record: %v", err)
+	}
+	defer gz.Close()
+
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, fmt.Errorf("kcl: reading cloudwatch logs record: %v", err)
+	}
+
+	var sub cloudWatchLogsSubscription
+	if err := json.Unmarshal(data, &sub); err != nil {
+		return nil, fmt.Errorf("kcl: unmarshaling cloudwatch logs record: %v", err)
+	}
+
+	if sub.MessageType == cloudWatchLogsControlMessage {
+		return nil, nil
+	}
+
+	source := aws.String(fmt.Sprintf("%s/%s", sub.LogGroup, sub.LogStream))
+	records := make([]*kinesis.Record, 0, len(sub.LogEvents))
+	for _, event := range sub.LogEvents {
+		records = append(records, &kinesis.Record{
+			Data:                        []byte(event.Message),
+			PartitionKey:                source,
+			SequenceNumber:              record.SequenceNumber,
+			ApproximateArrivalTimestamp: record.ApproximateArrivalTimestamp,
+		})
+	}
+
+	return records, nil
+}
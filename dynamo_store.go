@@ -0,0 +1,153 @@
+package kcl
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// DynamoStore implements Store on top of a DynamoDB table, so that multiple
+// consumer processes, potentially running in different containers, can
+// coordinate which shard each one owns and agree on a single checkpoint per
+// shard. This is the coordination the Java KCL provides through its own
+// lease table, and the reason this library exists.
+//
+// The table must have a string hash key named "StreamShard", populated as
+// "<stream>-<shard>".
+type DynamoStore struct {
+	svc   *dynamodb.DynamoDB
+	table string
+}
+
+// NewDynamoStore will return a pointer to a DynamoStore backed by the given
+// DynamoDB table.
+func NewDynamoStore(sess *session.Session, table string) *DynamoStore {
+	return &DynamoStore{
+		svc:   dynamodb.New(sess),
+		table: table,
+	}
+}
+
+// dynamoRecord is the shape of a single item in the checkpoint table.
+type dynamoRecord struct {
+	StreamShard string
+	Checkpoint  string `dynamodbav:",omitempty"`
+	OwnerID     string `dynamodbav:",omitempty"`
+	ExpiresAt   int64  `dynamodbav:",omitempty"`
+}
+
+// streamShardKey builds the hash key we use for a stream-shard combination.
+func streamShardKey(stream, shard string) string {
+	return fmt.Sprintf("%s-%s", stream, shard)
+}
+
+// GetShardIterator will get the checkpointed sequence number for the shard,
+// or "" if nothing has been checkpointed yet.
+func (s *DynamoStore) GetShardIterator(stream, shard string) (string, error) {
+	resp, err := s.svc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"StreamShard": {S: aws.String(streamShardKey(stream, shard))},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.Item == nil {
+		return "", nil
+	}
+
+	var record dynamoRecord
+	if err := dynamodbattribute.UnmarshalMap(resp.Item, &record); err != nil {
+		return "", err
+	}
+
+	return record.Checkpoint, nil
+}
+
+// UpdateShardIterator will checkpoint the given sequence number for the
+// shard.
+func (s *DynamoStore) UpdateShardIterator(stream, shard, iterator string) error {
+	_, err := s.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"StreamShard": {S: aws.String(streamShardKey(stream, shard))},
+		},
+		UpdateExpression: aws.String("SET Checkpoint = :checkpoint"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":checkpoint": {S: aws.String(iterator)},
+		},
+	})
+	return err
+}
+
+// AcquireShard attempts to take ownership of the shard for ownerID until ttl
+// elapses, using a conditional write so that only one process can win a
+// given lease: the write succeeds only if nobody owns the shard, ownerID
+// already owns it, or the current lease has expired.
+func (s *DynamoStore) AcquireShard(stream, shard, ownerID string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	_, err := s.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"StreamShard": {S: aws.String(streamShardKey(stream, shard))},
+		},
+		UpdateExpression:    aws.String("SET OwnerID = :owner, ExpiresAt = :expires"),
+		ConditionExpression: aws.String("attribute_not_exists(OwnerID) OR OwnerID = :owner OR ExpiresAt < :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner":   {S: aws.String(ownerID)},
+			":expires": {N: aws.String(fmt.Sprintf("%d", now.Add(ttl).Unix()))},
+			":now":     {N: aws.String(fmt.Sprintf("%d", now.Unix()))},
+		},
+	})
+	if err != nil {
+		if _, ok := err.(*dynamodb.ConditionalCheckFailedException); ok {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// RenewLease extends an already-acquired shard lease for another ttl.
+func (s *DynamoStore) RenewLease(stream, shard, ownerID string, ttl time.Duration) error {
+	acquired, err := s.AcquireShard(stream, shard, ownerID, ttl)
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return fmt.Errorf("kcl: %s is not owned by %s", streamShardKey(stream, shard), ownerID)
+	}
+
+	return nil
+}
+
+// ReleaseShard gives up ownership of the shard before its lease expires, for
+// example during a graceful shutdown, so another process can pick it up
+// immediately instead of waiting for the lease to time out.
+func (s *DynamoStore) ReleaseShard(stream, shard, ownerID string) error {
+	_, err := s.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"StreamShard": {S: aws.String(streamShardKey(stream, shard))},
+		},
+		UpdateExpression:    aws.String("REMOVE OwnerID, ExpiresAt"),
+		ConditionExpression: aws.String("OwnerID = :owner"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner": {S: aws.String(ownerID)},
+		},
+	})
+	if err != nil {
+		if _, ok := err.(*dynamodb.ConditionalCheckFailedException); ok {
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
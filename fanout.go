@@ -0,0 +1,360 @@
+package kcl
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// FanOutConfig sets some properties that affect how we interact with the Kinesis
+// stream when using enhanced fan-out.
+type FanOutConfig struct {
+	// ConsumerName is the name that will be registered with Kinesis for this
+	// consumer. If a consumer with this name is already registered on the
+	// stream, it will be reused instead of registering a new one.
+	ConsumerName string
+
+	// IteratorType is the type of iterator that we want to use to read from the
+	// stream. This denotes our starting position in the stream.
+	IteratorType string
+
+	// OwnerID identifies this consumer process when acquiring shard leases
+	// through Store, so that running more than one FanOutStream against the
+	// same stream and Store splits the shards between them instead of every
+	// process consuming every shard. If empty, leasing is skipped and every
+	// shard is consumed unconditionally.
+	OwnerID string
+
+	// LeaseTTL is how long a shard lease lasts before another owner may
+	// acquire it if it isn't renewed. Defaults to defaultLeaseTTL.
+	LeaseTTL time.Duration
+}
+
+// FanOutStream keeps track of where we are on the stream for each shard, and
+// reads records using Kinesis's enhanced fan-out API (SubscribeToShard) rather
+// than polling GetRecords. Each shard gets its own dedicated 2 MB/s throughput,
+// and records are pushed to the handler as soon as they arrive instead of on
+// a ticker, at the cost of a registered consumer that AWS bills for.
+type FanOutStream struct {
+	// Shards are all the shards that belong to the stream
+	Shards []Shard
+
+	// Logger is an interface that can be used to debug your stream
+	Logger Logger
+
+	// Name is the name of the stream
+	Name string
+
+	// config defines how we will interact with the underlying stream
+	config FanOutConfig
+
+	// The Kinesis service that we will use to make calls to AWS
+	svc *kinesis.Kinesis
+
+	// The store that we use to store the latest sequence number
+	store Store
+
+	// streamARN is the ARN of the stream, required by the enhanced fan-out APIs
+	streamARN string
+
+	// consumerARN is the ARN of the registered consumer that we subscribe
+	// shards through
+	consumerARN string
+}
+
+// NewFanOutStream will return a pointer to a FanOutStream that you can listen
+// on. It describes the stream to discover its shards, and registers (or
+// reuses) a stream consumer under config.ConsumerName.
+func NewFanOutStream(sess *session.Session, kinesisEndpoint string, stream string, store Store, config FanOutConfig) (*FanOutStream, error) {
+	svc := kinesis.New(sess, &aws.Config{Endpoint: aws.String(kinesisEndpoint)})
+	resp, err := svc.DescribeStream(&kinesis.DescribeStreamInput{
+		StreamName: aws.String(stream),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var shards = make([]Shard, 0)
+	for _, shard := range resp.StreamDescription.Shards {
+		s := Shard{
+			ID:      aws.StringValue(shard.ShardId),
+			StartAt: aws.StringValue(shard.SequenceNumberRange.StartingSequenceNumber),
+		}
+		shards = append(shards, s)
+	}
+
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("kcl: stream has 0 shards")
+	}
+
+	s := FanOutStream{
+		Shards:    shards,
+		Logger:    noOpLogger{},
+		config:    config,
+		Name:      stream,
+		svc:       svc,
+		store:     store,
+		streamARN: aws.StringValue(resp.StreamDescription.StreamARN),
+	}
+
+	consumerARN, err := s.registerConsumer()
+	if err != nil {
+		return nil, err
+	}
+	s.consumerARN = consumerARN
+
+	return &s, nil
+}
+
+// registerConsumer registers config.ConsumerName against the stream, reusing
+// the existing consumer ARN if one is already registered under that name, and
+// blocks until the consumer reaches the ACTIVE state.
+func (s *FanOutStream) registerConsumer() (string, error) {
+	describe, err := s.svc.DescribeStreamConsumer(&kinesis.DescribeStreamConsumerInput{
+		StreamARN:    aws.String(s.streamARN),
+		ConsumerName: aws.String(s.config.ConsumerName),
+	})
+	if err == nil {
+		return s.waitForActiveConsumer(aws.StringValue(describe.ConsumerDescription.ConsumerARN))
+	}
+
+	register, err := s.svc.RegisterStreamConsumer(&kinesis.RegisterStreamConsumerInput{
+		StreamARN:    aws.String(s.streamARN),
+		ConsumerName: aws.String(s.config.ConsumerName),
+	})
+	if err != nil {
+		return "", fmt.Errorf("kcl: registering stream consumer: %v", err)
+	}
+
+	return s.waitForActiveConsumer(aws.StringValue(register.Consumer.ConsumerARN))
+}
+
+// waitForActiveConsumer polls DescribeStreamConsumer until the consumer
+// reaches the ACTIVE state, which is required before we can call
+// SubscribeToShard against it.
+func (s *FanOutStream) waitForActiveConsumer(consumerARN string) (string, error) {
+	for {
+		resp, err := s.svc.DescribeStreamConsumer(&kinesis.DescribeStreamConsumerInput{
+			ConsumerARN: aws.String(consumerARN),
+		})
+		if err != nil {
+			return "", fmt.Errorf("kcl: describing stream consumer: %v", err)
+		}
+
+		status := aws.StringValue(resp.ConsumerDescription.ConsumerStatus)
+		s.Logger.Log("level", "info", "msg", "waiting for consumer to become active", "status", status)
+		if status == kinesis.ConsumerStatusActive {
+			return consumerARN, nil
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// Listen subscribes to every shard using enhanced fan-out and calls the
+// HandlerFunc for each batch of records Kinesis pushes to us. Unlike
+// Stream.Listen, there is no Config.Interval: records arrive over a push
+// event stream instead of being polled for. Listen blocks until every
+// shard's goroutine has returned, so a shard that closes cleanly doesn't
+// cause Listen to abandon the rest of the shards while their leases are
+// still held; it returns the first non-nil error any of them reported, if
+// any.
+func (s *FanOutStream) Listen(handler HandlerFunc) error {
+	errs := make(chan error, len(s.Shards))
+
+	for _, shard := range s.Shards {
+		go func(shard Shard) {
+			errs <- s.runShard(shard, handler)
+		}(shard)
+	}
+
+	var firstErr error
+	for range s.Shards {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// runShard acquires a lease on shard through Store, if config.OwnerID is
+// set, renews it for as long as consumeShard is running, and releases it
+// once consumeShard returns. It always just calls consumeShard when OwnerID
+// is empty, so FanOutStream behaves exactly as it did before leasing existed
+// when a caller doesn't opt into it.
+func (s *FanOutStream) runShard(shard Shard, handler HandlerFunc) error {
+	if !s.acquireShard(shard) {
+		return nil
+	}
+	defer s.releaseShard(shard)
+
+	stopRenew := make(chan struct{})
+	defer close(stopRenew)
+	go s.renewLease(shard, stopRenew)
+
+	return s.consumeShard(shard, handler)
+}
+
+// leaseTTL returns config.LeaseTTL, or defaultLeaseTTL if it is unset.
+func (s *FanOutStream) leaseTTL() time.Duration {
+	if s.config.LeaseTTL > 0 {
+		return s.config.LeaseTTL
+	}
+	return defaultLeaseTTL
+}
+
+// acquireShard takes ownership of shard for config.OwnerID through Store. It
+// always returns true when OwnerID is empty.
+func (s *FanOutStream) acquireShard(shard Shard) bool {
+	if s.config.OwnerID == "" {
+		return true
+	}
+
+	ok, err := s.store.AcquireShard(s.Name, shard.ID, s.config.OwnerID, s.leaseTTL())
+	if err != nil {
+		s.Logger.Log("level", "error", "msg", "failed to acquire shard lease", "shard", shard.ID, "error", err)
+		return false
+	}
+	if !ok {
+		s.Logger.Log("level", "info", "msg", "shard is owned by another consumer, skipping", "shard", shard.ID)
+	}
+	return ok
+}
+
+// renewLease renews config.OwnerID's lease on shard every leaseRenewInterval
+// until stop is closed, which happens as soon as consumeShard returns.
+func (s *FanOutStream) renewLease(shard Shard, stop <-chan struct{}) {
+	if s.config.OwnerID == "" {
+		return
+	}
+
+	tick := time.NewTicker(leaseRenewInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+			if err := s.store.RenewLease(s.Name, shard.ID, s.config.OwnerID, s.leaseTTL()); err != nil {
+				s.Logger.Log("level", "error", "msg", "failed to renew shard lease", "shard", shard.ID, "error", err)
+			}
+		}
+	}
+}
+
+// releaseShard gives up config.OwnerID's lease on shard, so another consumer
+// can pick it up immediately instead of waiting for the lease to expire.
+func (s *FanOutStream) releaseShard(shard Shard) {
+	if s.config.OwnerID == "" {
+		return
+	}
+
+	if err := s.store.ReleaseShard(s.Name, shard.ID, s.config.OwnerID); err != nil {
+		s.Logger.Log("level", "error", "msg", "failed to release shard lease", "shard", shard.ID, "error", err)
+	}
+}
+
+// consumeShard subscribes to a single shard and resubscribes every time the
+// subscription expires, which Kinesis does roughly every 5 minutes. It uses
+// the continuation sequence number from the previous event to resume exactly
+// where the last subscription left off. If Store already has a checkpoint
+// for the shard, left over from a previous run, the initial subscription
+// resumes immediately after it instead of starting over from
+// config.IteratorType, the same as Stream.initialIterator does for polling
+// consumers.
+func (s *FanOutStream) consumeShard(shard Shard, handler HandlerFunc) error {
+	position, err := s.initialPosition(shard)
+	if err != nil {
+		return err
+	}
+
+	for {
+		resp, err := s.svc.SubscribeToShard(&kinesis.SubscribeToShardInput{
+			ConsumerARN:      aws.String(s.consumerARN),
+			ShardId:          aws.String(shard.ID),
+			StartingPosition: position,
+		})
+		if err != nil {
+			return fmt.Errorf("kcl: subscribing to shard %s: %v", shard.ID, err)
+		}
+
+		continuation, err := s.drainSubscription(shard, resp, handler)
+		if err != nil {
+			return err
+		}
+
+		if continuation == "" {
+			return nil
+		}
+
+		position = &kinesis.StartingPosition{
+			Type:           aws.String(IteratorTypeAfterSequenceNumber),
+			SequenceNumber: aws.String(continuation),
+		}
+	}
+}
+
+// initialPosition finds the StartingPosition for a single shard's first
+// subscription. If we have a checkpointed sequence number for the shard in
+// the store already, we resume immediately after it; otherwise we fall back
+// to config.IteratorType.
+func (s *FanOutStream) initialPosition(shard Shard) (*kinesis.StartingPosition, error) {
+	checkpoint, err := s.store.GetShardIterator(s.Name, shard.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if checkpoint == "" {
+		return &kinesis.StartingPosition{Type: aws.String(s.config.IteratorType)}, nil
+	}
+
+	return &kinesis.StartingPosition{
+		Type:           aws.String(IteratorTypeAfterSequenceNumber),
+		SequenceNumber: aws.String(checkpoint),
+	}, nil
+}
+
+// drainSubscription reads events off of a single SubscribeToShard event
+// stream until Kinesis closes it, returning the last continuation sequence
+// number we saw so the caller knows where to resubscribe from. Each event's
+// records are passed to handler synchronously, and only checkpointed once
+// handler returns, so a crash mid-batch resumes at the batch instead of
+// after it, and records within a shard are never delivered out of order.
+func (s *FanOutStream) drainSubscription(shard Shard, resp *kinesis.SubscribeToShardOutput, handler HandlerFunc) (string, error) {
+	var continuation string
+	for event := range resp.EventStream.Events() {
+		e, ok := event.(*kinesis.SubscribeToShardEvent)
+		if !ok {
+			continue
+		}
+
+		s.Logger.Log("level", "info", "msg", "passing records to handler function", "shard", shard.ID)
+		handler(shard.ID, e.Records)
+
+		continuation = aws.StringValue(e.ContinuationSequenceNumber)
+		if err := s.store.UpdateShardIterator(s.Name, shard.ID, continuation); err != nil {
+			return "", err
+		}
+	}
+
+	if err := resp.EventStream.Err(); err != nil {
+		return "", fmt.Errorf("kcl: event stream for shard %s: %v", shard.ID, err)
+	}
+
+	return continuation, nil
+}
+
+// Close deregisters the consumer that was registered by NewFanOutStream.
+// Callers should call Close during shutdown so that Kinesis stops billing for
+// a consumer that is no longer in use.
+func (s *FanOutStream) Close() error {
+	_, err := s.svc.DeregisterStreamConsumer(&kinesis.DeregisterStreamConsumerInput{
+		ConsumerARN: aws.String(s.consumerARN),
+	})
+	return err
+}
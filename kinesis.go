@@ -2,9 +2,12 @@ package kcl
 
 import (
 	"fmt"
+	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/kinesis"
@@ -14,12 +17,32 @@ import (
 // for more detail.
 const (
 	IteratorTypeAtSequenceNumber    = "AT_SEQUENCE_NUMBER"
-	IteratorTypeAfterSequenceNumber = "AFTER_SEQUENCE_NUMER"
+	IteratorTypeAfterSequenceNumber = "AFTER_SEQUENCE_NUMBER"
 	IteratorTypeAtTimestamp         = "AT_TIMESTAMP"
 	IteratorTypeTrimHorizon         = "TRIM_HORIZON"
 	IteratorTypeLatest              = "LATEST"
 )
 
+// ReshardCheckInterval is how often Listen polls ListShards to discover
+// shards that appeared or disappeared because of a split or merge.
+const ReshardCheckInterval = 30 * time.Second
+
+// maxThroughputBackoff caps the base of the exponential backoff we apply when
+// GetRecords returns ProvisionedThroughputExceededException. Jitter puts each
+// sleep between half and one and a half times that base, so a single sleep
+// can reach 45 seconds.
+const maxThroughputBackoff = 30 * time.Second
+
+// defaultLeaseTTL is how long a shard lease lasts when Config.LeaseTTL (or
+// FanOutConfig.LeaseTTL) is left at its zero value. It must comfortably
+// exceed leaseRenewInterval so that a slow renewal doesn't let another
+// process steal the shard out from under us.
+const defaultLeaseTTL = 30 * time.Second
+
+// leaseRenewInterval is how often a shard's lease is renewed while it is
+// being consumed.
+const leaseRenewInterval = 10 * time.Second
+
 // Stream will keep track of where we are at on the stream for each shard
 type Stream struct {
 	// Shards are all the shards that belong to the stream
@@ -39,6 +62,26 @@ type Stream struct {
 
 	// The store that we use to store the latest iterator
 	store Store
+
+	// mutex guards Shards and consuming, since Listen mutates them from the
+	// resharding poll while per-shard goroutines are running concurrently.
+	mutex sync.Mutex
+
+	// consuming tracks which shard IDs already have a goroutine consuming
+	// them, so the resharding poll does not start a shard twice.
+	consuming map[string]bool
+
+	// done holds a channel per shard ID that is closed once that shard's
+	// consumeShard goroutine returns. startShards waits on a shard's parent
+	// channel(s) here before starting it, so a child shard created by a
+	// split or merge never overtakes its still-draining parent.
+	done map[string]chan struct{}
+
+	// retentionPeriod is how long the stream retains records, fetched once
+	// at NewStream time via DescribeStreamSummary. We use it to warn when a
+	// consumer is falling behind closely enough that records may be trimmed
+	// before it gets to them.
+	retentionPeriod time.Duration
 }
 
 // Config sets some properties that affect how we interact with the Kinesis
@@ -57,6 +100,29 @@ type Config struct {
 	// In order to not run into Kinesis limits, you should consider the size
 	// of your records.
 	Limit int64
+
+	// RecordTransformer, if set, is applied to every record returned by
+	// GetRecords before it reaches the HandlerFunc. This lets callers opt
+	// into a decoder like CloudWatchLogsDecoder without wrapping their
+	// handler by hand.
+	RecordTransformer RecordTransformer
+
+	// StartTimestamp is the position to start reading from when IteratorType
+	// is IteratorTypeAtTimestamp. It is ignored for every other IteratorType,
+	// and ignored entirely once a shard has a checkpoint in the store.
+	StartTimestamp *time.Time
+
+	// OwnerID identifies this consumer process when acquiring shard leases
+	// through Store, so that running more than one Stream against the same
+	// stream and Store splits the shards between them instead of every
+	// process consuming every shard. If empty, leasing is skipped and every
+	// shard is consumed unconditionally, matching the behavior of a single
+	// consumer process with a LocalStore.
+	OwnerID string
+
+	// LeaseTTL is how long a shard lease lasts before another owner may
+	// acquire it if it isn't renewed. Defaults to defaultLeaseTTL.
+	LeaseTTL time.Duration
 }
 
 // Shard is a shard on the Kinesis stream
@@ -66,11 +132,21 @@ type Shard struct {
 
 	// The sequence number to start at
 	StartAt string
+
+	// ParentShardID is the shard this shard split or merged from, or "" if
+	// it has no parent. startShards waits for the parent to finish draining
+	// before consuming this shard, so ordering is preserved across a reshard.
+	ParentShardID string
+
+	// AdjacentParentShardID is the second parent a shard has after a merge
+	// of two shards into one, or "" otherwise.
+	AdjacentParentShardID string
 }
 
 // HandlerFunc is the argument to the listen function, for every batch of records that comes
-// off of the Kinesis stream, we will call the HandlerFunc once.
-type HandlerFunc func(records []*kinesis.Record)
+// off of a shard, we will call the HandlerFunc once, along with the ID of the shard the
+// records came from so that downstream code can key state on it.
+type HandlerFunc func(shardID string, records []*kinesis.Record)
 
 // NewStream will return a pointer to a stream that you can listen on. Stream is capable of
 // managing multiple shards, printing out log statements, and polling Kinesis at a regular
@@ -87,8 +163,10 @@ func NewStream(sess *session.Session, kinesisEndpoint string, stream string, sto
 	var shards = make([]Shard, 0)
 	for _, shard := range resp.StreamDescription.Shards {
 		s := Shard{
-			ID:      aws.StringValue(shard.ShardId),
-			StartAt: aws.StringValue(shard.SequenceNumberRange.StartingSequenceNumber),
+			ID:                    aws.StringValue(shard.ShardId),
+			StartAt:               aws.StringValue(shard.SequenceNumberRange.StartingSequenceNumber),
+			ParentShardID:         aws.StringValue(shard.ParentShardId),
+			AdjacentParentShardID: aws.StringValue(shard.AdjacentParentShardId),
 		}
 		shards = append(shards, s)
 	}
@@ -97,82 +175,442 @@ func NewStream(sess *session.Session, kinesisEndpoint string, stream string, sto
 		return nil, fmt.Errorf("kcl: stream has 0 shards")
 	}
 
+	summary, err := svc.DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(stream),
+	})
+	if err != nil {
+		return nil, err
+	}
+	retentionPeriod := time.Duration(aws.Int64Value(summary.StreamDescriptionSummary.RetentionPeriodHours)) * time.Hour
+
 	s := Stream{
-		Shards: shards,
-		Logger: noOpLogger{},
-		config: config,
-		Name:   stream,
-		svc:    svc,
-		store:  store,
+		Shards:          shards,
+		Logger:          noOpLogger{},
+		config:          config,
+		Name:            stream,
+		svc:             svc,
+		store:           store,
+		consuming:       make(map[string]bool),
+		done:            make(map[string]chan struct{}),
+		retentionPeriod: retentionPeriod,
 	}
 
 	return &s, nil
 }
 
 // Listen will call the HandlerFunc for each batch of events that come off the Kinesis stream.
-// Listen will poll the Kinesis Stream every interval, and handle any new records. We use the
-// store to keep track of our position in the stream so that we avoid reading recoreds twice,
-// or not progressing in the stream.
+// Each shard is consumed by its own goroutine, polling GetRecords every Config.Interval, so
+// that a slow or backed-up shard cannot delay the others. Listen also polls ListShards every
+// ReshardCheckInterval to discover shards created by a split or merge after NewStream ran, and
+// starts a goroutine for each one it hasn't seen before. Listen blocks until a shard goroutine
+// returns an error or a ListShards call fails; it keeps running after every shard has been
+// drained.
 func (s *Stream) Listen(handler HandlerFunc) error {
-	tick := time.NewTicker(s.config.Interval).C
+	errs := make(chan error, 1)
+
+	s.startShards(s.Shards, handler, errs)
+
+	reshardTick := time.NewTicker(ReshardCheckInterval)
+	defer reshardTick.Stop()
+
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case <-reshardTick.C:
+			shards, err := s.listShards()
+			if err != nil {
+				return err
+			}
+
+			s.mutex.Lock()
+			s.Shards = shards
+			s.mutex.Unlock()
+
+			s.startShards(shards, handler, errs)
+		}
+	}
+}
+
+// startShards launches a consumeShard goroutine for every shard that does not
+// already have one running, recording each error it returns on errs. If a
+// shard has a parent (or two, after a merge) that we are also consuming, its
+// goroutine waits for the parent's to finish draining before calling
+// consumeShard, so records from a split or merge are never delivered out of
+// order. If Config.OwnerID is set, the goroutine first acquires a lease on
+// the shard through Store, so that running more than one Stream against the
+// same stream splits the shards between them instead of double-consuming.
+//
+// This runs in two passes over shards: the first registers every new shard's
+// done channel, and the second looks up parent channels and launches
+// goroutines. ListShards/DescribeStream don't guarantee a parent appears
+// before its children, so looking up a parent's channel while still in the
+// middle of registering this same batch could otherwise miss it and let the
+// child start unguarded.
+func (s *Stream) startShards(shards []Shard, handler HandlerFunc, errs chan<- error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var newShards []Shard
+	for _, shard := range shards {
+		if s.consuming[shard.ID] {
+			continue
+		}
+		s.consuming[shard.ID] = true
+		s.done[shard.ID] = make(chan struct{})
+		newShards = append(newShards, shard)
+	}
+
+	for _, shard := range newShards {
+		done := s.done[shard.ID]
 
-	// Set the starting position for each shard
-	err := setInitialIterators(s)
+		var parents []chan struct{}
+		if ch, ok := s.done[shard.ParentShardID]; ok {
+			parents = append(parents, ch)
+		}
+		if ch, ok := s.done[shard.AdjacentParentShardID]; ok {
+			parents = append(parents, ch)
+		}
+
+		go func(shard Shard, done chan struct{}, parents []chan struct{}) {
+			defer close(done)
+
+			for _, parent := range parents {
+				<-parent
+			}
+
+			if !s.acquireShard(shard) {
+				s.mutex.Lock()
+				delete(s.consuming, shard.ID)
+				s.mutex.Unlock()
+				return
+			}
+			defer s.releaseShard(shard)
+
+			stopRenew := make(chan struct{})
+			defer close(stopRenew)
+			go s.renewLease(shard, stopRenew)
+
+			if err := s.consumeShard(shard, handler); err != nil {
+				select {
+				case errs <- err:
+				default:
+				}
+			}
+		}(shard, done, parents)
+	}
+}
+
+// leaseTTL returns Config.LeaseTTL, or defaultLeaseTTL if it is unset.
+func (s *Stream) leaseTTL() time.Duration {
+	if s.config.LeaseTTL > 0 {
+		return s.config.LeaseTTL
+	}
+	return defaultLeaseTTL
+}
+
+// acquireShard takes ownership of shard for Config.OwnerID through Store. It
+// always returns true when OwnerID is empty, so Stream behaves exactly as it
+// did before leasing existed when a caller doesn't opt into it.
+func (s *Stream) acquireShard(shard Shard) bool {
+	if s.config.OwnerID == "" {
+		return true
+	}
+
+	ok, err := s.store.AcquireShard(s.Name, shard.ID, s.config.OwnerID, s.leaseTTL())
 	if err != nil {
-		return err
+		s.Logger.Log("level", "error", "msg", "failed to acquire shard lease", "shard", shard.ID, "error", err)
+		return false
+	}
+	if !ok {
+		s.Logger.Log("level", "info", "msg", "shard is owned by another consumer, skipping", "shard", shard.ID)
+	}
+	return ok
+}
+
+// renewLease renews Config.OwnerID's lease on shard every leaseRenewInterval
+// until stop is closed, which happens as soon as consumeShard returns.
+func (s *Stream) renewLease(shard Shard, stop <-chan struct{}) {
+	if s.config.OwnerID == "" {
+		return
 	}
 
-	// Start listening
+	tick := time.NewTicker(leaseRenewInterval)
+	defer tick.Stop()
+
 	for {
 		select {
-		case <-tick:
-			s.Logger.Log("level", "info", "msg", "tick")
-			for _, shard := range s.Shards {
-				iterator, err := s.store.GetShardIterator(s.Name, shard.ID)
-				if err != nil {
-					return err
-				}
+		case <-stop:
+			return
+		case <-tick.C:
+			if err := s.store.RenewLease(s.Name, shard.ID, s.config.OwnerID, s.leaseTTL()); err != nil {
+				s.Logger.Log("level", "error", "msg", "failed to renew shard lease", "shard", shard.ID, "error", err)
+			}
+		}
+	}
+}
 
-				s.Logger.Log("level", "info", "msg", "getting records for shard", "shard", shard.ID, "iterator", iterator)
-				resp, err := s.svc.GetRecords(&kinesis.GetRecordsInput{
-					Limit:         aws.Int64(s.config.Limit),
-					ShardIterator: aws.String(iterator),
-				})
-				if err != nil {
-					return err
-				}
+// releaseShard gives up Config.OwnerID's lease on shard, so another consumer
+// can pick it up immediately instead of waiting for the lease to expire.
+func (s *Stream) releaseShard(shard Shard) {
+	if s.config.OwnerID == "" {
+		return
+	}
 
-				s.Logger.Log("level", "info", "msg", "passing records to handler function")
-				go handler(resp.Records)
+	if err := s.store.ReleaseShard(s.Name, shard.ID, s.config.OwnerID); err != nil {
+		s.Logger.Log("level", "error", "msg", "failed to release shard lease", "shard", shard.ID, "error", err)
+	}
+}
 
-				err = s.store.UpdateShardIterator(s.Name, shard.ID, aws.StringValue(resp.NextShardIterator))
-				if err != nil {
-					return err
-				}
+// consumeShard polls a single shard for new records every Config.Interval and
+// passes them to handler, one batch at a time, waiting for handler to return
+// before checkpointing or fetching the next batch. This keeps records within
+// a shard in order and guarantees a checkpoint is never advanced past a batch
+// handler hasn't actually finished processing. When the shard is closed (a
+// parent shard after a split or merge), GetRecords stops returning a
+// NextShardIterator once the parent's records have all been delivered;
+// consumeShard drains the last batch and returns, which is what lets
+// startShards start the child shard's consumer in turn.
+func (s *Stream) consumeShard(shard Shard, handler HandlerFunc) error {
+	iterator, err := s.initialIterator(shard)
+	if err != nil {
+		return err
+	}
+
+	tick := time.NewTicker(s.config.Interval)
+	defer tick.Stop()
+
+	for range tick.C {
+		s.Logger.Log("level", "info", "msg", "getting records for shard", "shard", shard.ID, "iterator", iterator)
+		resp, next, err := s.getRecords(shard, iterator)
+		if err != nil {
+			return err
+		}
+		iterator = next
+
+		if behind := time.Duration(aws.Int64Value(resp.MillisBehindLatest)) * time.Millisecond; s.retentionPeriod > 0 && behind > s.retentionPeriod*9/10 {
+			s.Logger.Log("level", "error", "msg", "consumer is close to the stream's retention period and may lose records to trimming", "shard", shard.ID, "millisBehindLatest", aws.Int64Value(resp.MillisBehindLatest), "retentionPeriod", s.retentionPeriod)
+		}
+
+		s.Logger.Log("level", "info", "msg", "passing records to handler function", "shard", shard.ID)
+		handler(shard.ID, s.transform(shard, resp.Records))
+
+		if n := len(resp.Records); n > 0 {
+			checkpoint := aws.StringValue(resp.Records[n-1].SequenceNumber)
+			if err := s.store.UpdateShardIterator(s.Name, shard.ID, checkpoint); err != nil {
+				return err
 			}
 		}
+
+		if resp.NextShardIterator == nil {
+			s.Logger.Log("level", "info", "msg", "shard is closed, all records drained", "shard", shard.ID)
+			return nil
+		}
 	}
+
+	return nil
 }
 
-// setInitialIterators will find the starting position for all shards based on the
-// iterator type given in the config
-func setInitialIterators(s *Stream) error {
-	// Get the initial position of all the shards
-	s.Logger.Log("level", "info", "msg", "getting initial shard iterators for all shards")
-	for _, shard := range s.Shards {
-		resp, err := s.svc.GetShardIterator(&kinesis.GetShardIteratorInput{
-			ShardId:           aws.String(shard.ID),
-			ShardIteratorType: aws.String(s.config.IteratorType),
-			StreamName:        aws.String(s.Name),
+// getRecords calls GetRecords and returns the response along with the
+// iterator to use on the next call. It transparently recovers from the two
+// errors GetRecords is documented to return in normal operation: on
+// ExpiredIteratorException it reissues a fresh iterator from the last
+// checkpointed sequence number, and on ProvisionedThroughputExceededException
+// it retries with exponential backoff and jitter instead of propagating the
+// error up and killing the consumer.
+func (s *Stream) getRecords(shard Shard, iterator string) (*kinesis.GetRecordsOutput, string, error) {
+	backoff := time.Second
+	for {
+		resp, err := s.svc.GetRecords(&kinesis.GetRecordsInput{
+			Limit:         aws.Int64(s.config.Limit),
+			ShardIterator: aws.String(iterator),
 		})
+		if err == nil {
+			return resp, aws.StringValue(resp.NextShardIterator), nil
+		}
+
+		aerr, ok := err.(awserr.Error)
+		if !ok {
+			return nil, "", err
+		}
+
+		switch aerr.Code() {
+		case kinesis.ErrCodeExpiredIteratorException:
+			checkpoint, err := s.store.GetShardIterator(s.Name, shard.ID)
+			if err != nil {
+				return nil, "", err
+			}
+
+			if checkpoint == "" {
+				// We've never checkpointed this shard, so there is no safe
+				// position to resume from: falling back to Config.IteratorType
+				// re-reads LATEST (skipping whatever arrived since we started,
+				// a gap) or TRIM_HORIZON (reading everything again, a
+				// duplicate) depending on what the caller configured. Neither
+				// is "recovery" in the way resuming from a checkpoint is, so
+				// we call it out loudly instead of logging it the same as the
+				// checkpointed case below.
+				s.Logger.Log("level", "error", "msg", "shard iterator expired before we ever checkpointed a record, reissuing from Config.IteratorType which may skip or duplicate records", "shard", shard.ID, "iteratorType", s.config.IteratorType)
+			} else {
+				s.Logger.Log("level", "warn", "msg", "shard iterator expired, reissuing from last checkpoint", "shard", shard.ID)
+			}
+
+			iterator, err = s.shardIteratorFor(shard, checkpoint)
+			if err != nil {
+				return nil, "", err
+			}
+		case kinesis.ErrCodeProvisionedThroughputExceededException:
+			sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+			s.Logger.Log("level", "warn", "msg", "provisioned throughput exceeded, backing off", "shard", shard.ID, "backoff", sleep)
+			time.Sleep(sleep)
+			if backoff *= 2; backoff > maxThroughputBackoff {
+				backoff = maxThroughputBackoff
+			}
+		default:
+			return nil, "", err
+		}
+	}
+}
+
+// transform applies Config.RecordTransformer to each record, if one is set.
+// A record that the transformer errors on is logged and dropped rather than
+// failing the whole batch, since a single malformed record shouldn't be able
+// to take down an otherwise healthy shard consumer.
+func (s *Stream) transform(shard Shard, records []*kinesis.Record) []*kinesis.Record {
+	if s.config.RecordTransformer == nil {
+		return records
+	}
+
+	transformed := make([]*kinesis.Record, 0, len(records))
+	for _, record := range records {
+		out, err := s.config.RecordTransformer(record)
 		if err != nil {
-			return err
+			s.Logger.Log("level", "error", "msg", "failed to transform record", "shard", shard.ID, "error", err)
+			continue
 		}
-		err = s.store.UpdateShardIterator(s.Name, shard.ID, aws.StringValue(resp.ShardIterator))
+		transformed = append(transformed, out...)
+	}
+
+	return transformed
+}
+
+// initialIterator finds the starting position for a single shard. If we have
+// a checkpointed sequence number for the shard in the store already, left
+// over from a previous run, we resume immediately after it; otherwise we
+// fall back to the iterator type given in the config. Checkpointing by
+// sequence number rather than storing the iterator string itself matters
+// because a shard iterator expires after about 5 minutes, so a restart that
+// resumed from a stored iterator would usually find it already invalid.
+//
+// If we do have a checkpoint, we also check it against the stream's
+// retention period before consuming anything, since a consumer that was
+// down longer than retentionPeriod will have a checkpoint that already fell
+// out of the stream; resuming from it would silently skip every record
+// between the checkpoint and wherever the stream was actually trimmed to.
+func (s *Stream) initialIterator(shard Shard) (string, error) {
+	checkpoint, err := s.store.GetShardIterator(s.Name, shard.ID)
+	if err != nil {
+		return "", err
+	}
+
+	if checkpoint != "" {
+		trimmed, err := s.checkpointTrimmed(shard, checkpoint)
 		if err != nil {
-			return err
+			return "", err
+		}
+		if trimmed {
+			s.Logger.Log("level", "error", "msg", "checkpoint predates the stream's retention period, records between it and the trim horizon were lost", "shard", shard.ID, "retentionPeriod", s.retentionPeriod)
 		}
 	}
 
-	return nil
+	return s.shardIteratorFor(shard, checkpoint)
+}
+
+// checkpointTrimmed reports whether checkpoint, a previously checkpointed
+// sequence number for shard, has already fallen out of the stream's
+// retention window. Kinesis doesn't error on GetShardIterator for a trimmed
+// sequence number; it hands back an iterator positioned at the oldest
+// record it still has for the shard instead. We detect the trim by reading
+// one record back from that iterator and checking whether its sequence
+// number is still the one we asked for.
+func (s *Stream) checkpointTrimmed(shard Shard, checkpoint string) (bool, error) {
+	resp, err := s.svc.GetShardIterator(&kinesis.GetShardIteratorInput{
+		ShardId:                aws.String(shard.ID),
+		StreamName:             aws.String(s.Name),
+		ShardIteratorType:      aws.String(IteratorTypeAtSequenceNumber),
+		StartingSequenceNumber: aws.String(checkpoint),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	records, err := s.svc.GetRecords(&kinesis.GetRecordsInput{
+		Limit:         aws.Int64(1),
+		ShardIterator: resp.ShardIterator,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if len(records.Records) == 0 {
+		return false, nil
+	}
+
+	return aws.StringValue(records.Records[0].SequenceNumber) != checkpoint, nil
+}
+
+// shardIteratorFor builds an iterator for the shard. If checkpoint is set, it
+// resumes immediately after that sequence number; otherwise it falls back to
+// Config.IteratorType, passing Config.StartTimestamp along when that type is
+// IteratorTypeAtTimestamp.
+func (s *Stream) shardIteratorFor(shard Shard, checkpoint string) (string, error) {
+	input := &kinesis.GetShardIteratorInput{
+		ShardId:    aws.String(shard.ID),
+		StreamName: aws.String(s.Name),
+	}
+	if checkpoint != "" {
+		input.ShardIteratorType = aws.String(IteratorTypeAfterSequenceNumber)
+		input.StartingSequenceNumber = aws.String(checkpoint)
+	} else {
+		input.ShardIteratorType = aws.String(s.config.IteratorType)
+		if s.config.IteratorType == IteratorTypeAtTimestamp {
+			input.Timestamp = s.config.StartTimestamp
+		}
+	}
+
+	resp, err := s.svc.GetShardIterator(input)
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(resp.ShardIterator), nil
+}
+
+// listShards calls Kinesis's ListShards API to discover the current set of
+// shards on the stream. Unlike the shards captured by DescribeStream in
+// NewStream, this reflects any splits or merges that have happened since.
+func (s *Stream) listShards() ([]Shard, error) {
+	var shards []Shard
+
+	input := &kinesis.ListShardsInput{StreamName: aws.String(s.Name)}
+	for {
+		resp, err := s.svc.ListShards(input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, shard := range resp.Shards {
+			shards = append(shards, Shard{
+				ID:                    aws.StringValue(shard.ShardId),
+				StartAt:               aws.StringValue(shard.SequenceNumberRange.StartingSequenceNumber),
+				ParentShardID:         aws.StringValue(shard.ParentShardId),
+				AdjacentParentShardID: aws.StringValue(shard.AdjacentParentShardId),
+			})
+		}
+
+		if resp.NextToken == nil {
+			return shards, nil
+		}
+		input = &kinesis.ListShardsInput{NextToken: resp.NextToken}
+	}
 }
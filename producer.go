@@ -0,0 +1,250 @@
+package kcl
+
+import (
+	"crypto/md5"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// maxPutRecordsRetries bounds how many times Producer will resubmit entries
+// that PutRecords reports as failed before giving up on them.
+const maxPutRecordsRetries = 5
+
+// ProducerConfig sets some properties that affect how Producer batches and
+// flushes records.
+type ProducerConfig struct {
+	// MaxRecordSize is the largest an aggregated Kinesis record is allowed to
+	// grow to before Producer flushes it. Kinesis caps a record at 1 MB;
+	// this defaults to that if left unset.
+	MaxRecordSize int
+
+	// MaxRecordCount is the largest number of user records Producer will
+	// pack into a single aggregated Kinesis record before flushing it.
+	// Defaults to 500 if left unset.
+	MaxRecordCount int
+
+	// Linger is how long Producer will hold buffered records hoping to pack
+	// in more before flushing anyway. If zero, records are only flushed once
+	// MaxRecordSize or MaxRecordCount is hit, or Flush is called.
+	Linger time.Duration
+}
+
+// producerShard is a shard's hash key range, used to pin an aggregated
+// record to a specific shard via PutRecordsRequestEntry.ExplicitHashKey.
+type producerShard struct {
+	id              string
+	startingHashKey *big.Int
+	endingHashKey   *big.Int
+}
+
+// Producer batches user records into Kinesis records using Kinesis Producer
+// Library (KPL) style aggregation: many user records are packed into a
+// single Kinesis record so that PutRecords's per-record overhead is spread
+// across all of them. It is safe for concurrent use.
+type Producer struct {
+	// Logger is an interface that can be used to debug your producer
+	Logger Logger
+
+	svc    *kinesis.Kinesis
+	stream string
+	config ProducerConfig
+	shards []producerShard
+
+	mutex   sync.Mutex
+	buffers map[string]*aggregator
+}
+
+// NewProducer will return a pointer to a Producer for the given stream. It
+// describes the stream up front to learn each shard's hash key range, which
+// Put uses to pin aggregated records to the shard their partition keys hash
+// to.
+func NewProducer(sess *session.Session, kinesisEndpoint, stream string, config ProducerConfig) (*Producer, error) {
+	svc := kinesis.New(sess, &aws.Config{Endpoint: aws.String(kinesisEndpoint)})
+	resp, err := svc.DescribeStream(&kinesis.DescribeStreamInput{
+		StreamName: aws.String(stream),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var shards []producerShard
+	for _, shard := range resp.StreamDescription.Shards {
+		startingHashKey, ok := new(big.Int).SetString(aws.StringValue(shard.HashKeyRange.StartingHashKey), 10)
+		if !ok {
+			return nil, fmt.Errorf("kcl: invalid starting hash key for shard %s", aws.StringValue(shard.ShardId))
+		}
+		endingHashKey, ok := new(big.Int).SetString(aws.StringValue(shard.HashKeyRange.EndingHashKey), 10)
+		if !ok {
+			return nil, fmt.Errorf("kcl: invalid ending hash key for shard %s", aws.StringValue(shard.ShardId))
+		}
+
+		shards = append(shards, producerShard{
+			id:              aws.StringValue(shard.ShardId),
+			startingHashKey: startingHashKey,
+			endingHashKey:   endingHashKey,
+		})
+	}
+
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("kcl: stream has 0 shards")
+	}
+
+	if config.MaxRecordSize == 0 {
+		config.MaxRecordSize = 1 << 20
+	}
+	if config.MaxRecordCount == 0 {
+		config.MaxRecordCount = 500
+	}
+
+	p := &Producer{
+		Logger:  noOpLogger{},
+		svc:     svc,
+		stream:  stream,
+		config:  config,
+		shards:  shards,
+		buffers: make(map[string]*aggregator),
+	}
+
+	if config.Linger > 0 {
+		go p.lingerLoop()
+	}
+
+	return p, nil
+}
+
+// Put adds a user record to the buffer for the shard its partition key
+// hashes to, flushing that shard's buffer with PutRecords once it grows
+// past ProducerConfig.MaxRecordSize or ProducerConfig.MaxRecordCount.
+func (p *Producer) Put(partitionKey string, data []byte) error {
+	shard := p.shardFor(partitionKey)
+
+	p.mutex.Lock()
+	buf, ok := p.buffers[shard.id]
+	if !ok {
+		buf = newAggregator()
+		p.buffers[shard.id] = buf
+	}
+	buf.add(partitionKey, data)
+
+	var flush map[string]*aggregator
+	if buf.size+aggregatedRecordOverhead >= p.config.MaxRecordSize || buf.count() >= p.config.MaxRecordCount {
+		flush = map[string]*aggregator{shard.id: buf}
+		delete(p.buffers, shard.id)
+	}
+	p.mutex.Unlock()
+
+	if flush == nil {
+		return nil
+	}
+
+	return p.flush(flush)
+}
+
+// Flush immediately flushes every shard's buffered records, without waiting
+// for ProducerConfig.Linger to elapse.
+func (p *Producer) Flush() error {
+	p.mutex.Lock()
+	pending := p.buffers
+	p.buffers = make(map[string]*aggregator)
+	p.mutex.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	return p.flush(pending)
+}
+
+// lingerLoop flushes every shard's buffer at least every ProducerConfig.Linger, so a
+// slow trickle of Put calls isn't left waiting forever for a buffer to fill
+// up on its own.
+func (p *Producer) lingerLoop() {
+	tick := time.NewTicker(p.config.Linger)
+	defer tick.Stop()
+
+	for range tick.C {
+		if err := p.Flush(); err != nil {
+			p.Logger.Log("level", "error", "msg", "failed to flush buffered records", "error", err)
+		}
+	}
+}
+
+// flush sends one aggregated Kinesis record per shard buffer to PutRecords,
+// pinning each to its shard with ExplicitHashKey, and resubmits only the
+// entries PutRecords reports as failed.
+func (p *Producer) flush(buffers map[string]*aggregator) error {
+	entries := make([]*kinesis.PutRecordsRequestEntry, 0, len(buffers))
+	for shardID, buf := range buffers {
+		shard := p.shardByID(shardID)
+		entries = append(entries, &kinesis.PutRecordsRequestEntry{
+			Data:            buf.encode(),
+			PartitionKey:    aws.String(buf.partitionKeyTable[0]),
+			ExplicitHashKey: aws.String(shard.startingHashKey.String()),
+		})
+	}
+
+	for attempt := 0; attempt <= maxPutRecordsRetries && len(entries) > 0; attempt++ {
+		resp, err := p.svc.PutRecords(&kinesis.PutRecordsInput{
+			StreamName: aws.String(p.stream),
+			Records:    entries,
+		})
+		if err != nil {
+			return err
+		}
+
+		if aws.Int64Value(resp.FailedRecordCount) == 0 {
+			return nil
+		}
+
+		var retry []*kinesis.PutRecordsRequestEntry
+		for i, result := range resp.Records {
+			if aws.StringValue(result.ErrorCode) != "" {
+				p.Logger.Log("level", "warn", "msg", "retrying failed PutRecords entry", "errorCode", aws.StringValue(result.ErrorCode))
+				retry = append(retry, entries[i])
+			}
+		}
+
+		entries = retry
+		time.Sleep(time.Duration(attempt+1) * 100 * time.Millisecond)
+	}
+
+	if len(entries) > 0 {
+		return fmt.Errorf("kcl: %d records failed PutRecords after %d retries", len(entries), maxPutRecordsRetries)
+	}
+
+	return nil
+}
+
+// shardFor picks the shard a partition key's MD5 hash falls into, the same
+// technique Kinesis itself uses to route a PutRecord call that only
+// specifies PartitionKey rather than an ExplicitHashKey.
+func (p *Producer) shardFor(partitionKey string) producerShard {
+	sum := md5.Sum([]byte(partitionKey))
+	hashKey := new(big.Int).SetBytes(sum[:])
+
+	for _, shard := range p.shards {
+		if hashKey.Cmp(shard.startingHashKey) >= 0 && hashKey.Cmp(shard.endingHashKey) <= 0 {
+			return shard
+		}
+	}
+
+	return p.shards[0]
+}
+
+// shardByID looks up a shard by ID. Producer's shard list is fixed at
+// NewProducer time, so this only fails to find a match if called with a
+// shard ID that didn't come from p.shards in the first place.
+func (p *Producer) shardByID(id string) producerShard {
+	for _, shard := range p.shards {
+		if shard.id == id {
+			return shard
+		}
+	}
+	return producerShard{}
+}
@@ -0,0 +1,56 @@
+package kcl
+
+import (
+	"crypto/md5"
+	"math/big"
+	"testing"
+)
+
+func TestProducerShardFor(t *testing.T) {
+	low := &Producer{
+		shards: []producerShard{
+			{id: "shard-low", startingHashKey: big.NewInt(0), endingHashKey: big.NewInt(1 << 62)},
+			{id: "shard-high", startingHashKey: new(big.Int).Add(big.NewInt(1<<62), big.NewInt(1)), endingHashKey: new(big.Int).SetBytes(maxHash())},
+		},
+	}
+
+	for _, partitionKey := range []string{"alice", "bob", "carol", "dave"} {
+		sum := md5.Sum([]byte(partitionKey))
+		hashKey := new(big.Int).SetBytes(sum[:])
+
+		got := low.shardFor(partitionKey).id
+
+		var want string
+		if hashKey.Cmp(low.shards[0].endingHashKey) <= 0 {
+			want = "shard-low"
+		} else {
+			want = "shard-high"
+		}
+
+		if got != want {
+			t.Errorf("shardFor(%q) = %q, want %q", partitionKey, got, want)
+		}
+	}
+}
+
+func TestProducerShardForFallsBackWhenHashKeyIsOutOfRange(t *testing.T) {
+	p := &Producer{
+		shards: []producerShard{
+			{id: "only-shard", startingHashKey: big.NewInt(0), endingHashKey: big.NewInt(0)},
+		},
+	}
+
+	if got := p.shardFor("anything").id; got != "only-shard" {
+		t.Errorf("shardFor = %q, want %q", got, "only-shard")
+	}
+}
+
+// maxHash returns the largest value an MD5 sum can take, the same range
+// Kinesis partitions a shard's hash key space across.
+func maxHash() []byte {
+	max := make([]byte, md5.Size)
+	for i := range max {
+		max[i] = 0xFF
+	}
+	return max
+}
@@ -0,0 +1,105 @@
+package kcl
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// RedisStore implements Store on top of Redis, using a SET NX-style lock for
+// shard leases and a plain key per shard for checkpoints. This is a lighter
+// weight alternative to DynamoStore for teams that already run Redis.
+type RedisStore struct {
+	client *redis.Client
+}
+
+// NewRedisStore will return a pointer to a RedisStore backed by the given
+// Redis client.
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+// redisCheckpointKey builds the key we checkpoint a shard's sequence number
+// under.
+func redisCheckpointKey(stream, shard string) string {
+	return fmt.Sprintf("kcl:%s:%s:checkpoint", stream, shard)
+}
+
+// redisLeaseKey builds the key we store a shard's current owner under.
+func redisLeaseKey(stream, shard string) string {
+	return fmt.Sprintf("kcl:%s:%s:owner", stream, shard)
+}
+
+// GetShardIterator will get the checkpointed sequence number for the shard,
+// or "" if nothing has been checkpointed yet.
+func (s *RedisStore) GetShardIterator(stream, shard string) (string, error) {
+	val, err := s.client.Get(redisCheckpointKey(stream, shard)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return val, err
+}
+
+// UpdateShardIterator will checkpoint the given sequence number for the
+// shard.
+func (s *RedisStore) UpdateShardIterator(stream, shard, iterator string) error {
+	return s.client.Set(redisCheckpointKey(stream, shard), iterator, 0).Err()
+}
+
+// AcquireShard attempts to take ownership of the shard for ownerID until ttl
+// elapses. It uses SET NX so that only one process can win a free or expired
+// lease, and also succeeds when ownerID already holds the lease so that a
+// periodic renewal can go through AcquireShard too.
+func (s *RedisStore) AcquireShard(stream, shard, ownerID string, ttl time.Duration) (bool, error) {
+	key := redisLeaseKey(stream, shard)
+	ok, err := s.client.SetNX(key, ownerID, ttl).Result()
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		return true, nil
+	}
+
+	current, err := s.client.Get(key).Result()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	if current != ownerID {
+		return false, nil
+	}
+
+	return true, s.client.Expire(key, ttl).Err()
+}
+
+// RenewLease extends an already-acquired shard lease for another ttl.
+func (s *RedisStore) RenewLease(stream, shard, ownerID string, ttl time.Duration) error {
+	acquired, err := s.AcquireShard(stream, shard, ownerID, ttl)
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return fmt.Errorf("kcl: %s-%s is not owned by %s", stream, shard, ownerID)
+	}
+
+	return nil
+}
+
+// ReleaseShard gives up ownership of the shard before its lease expires, so
+// another process can pick it up immediately instead of waiting for the
+// lease to time out.
+func (s *RedisStore) ReleaseShard(stream, shard, ownerID string) error {
+	key := redisLeaseKey(stream, shard)
+	current, err := s.client.Get(key).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if current != ownerID {
+		return nil
+	}
+
+	return s.client.Del(key).Err()
+}
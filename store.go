@@ -3,42 +3,71 @@ package kcl
 import (
 	"fmt"
 	"sync"
+	"time"
 )
 
-// Store is an interface that defines how we will persist and retrieve
-// the shard iterator. It is important to keep track of the shard iterator
-// so that we know our position in the stream. The implementation of Store
-// must be safe for concurrent use.
+// Store is an interface that defines how we will persist and retrieve our
+// checkpoint in each shard, and how consumer processes coordinate ownership
+// of shards between themselves. The implementation of Store must be safe
+// for concurrent use.
 type Store interface {
-	// GetShardIterator will get the current iterator for the shard. This
-	// tells Amazon where we want to start reading records from.
+	// GetShardIterator will get the last checkpointed sequence number for the
+	// shard, or "" if nothing has been checkpointed yet. This tells us where
+	// to resume reading records from via an AFTER_SEQUENCE_NUMBER iterator.
 	GetShardIterator(stream, shard string) (string, error)
 
-	// UpdateShardIterator will update the position in the shard so that
-	// on the next tick of our listener, we read records from the latest
-	// position.
+	// UpdateShardIterator will checkpoint the given sequence number for the
+	// shard, so that after a restart we can resume from it instead of from
+	// Config.IteratorType.
 	UpdateShardIterator(stream, shard, iterator string) error
+
+	// AcquireShard attempts to take ownership of the shard for ownerID for
+	// ttl. It returns true if ownership was granted, and false if the shard
+	// is already owned by a different ownerID whose lease has not expired.
+	// Implementations must also return true when ownerID already holds the
+	// lease, so that a consumer can call AcquireShard again to renew it.
+	AcquireShard(stream, shard, ownerID string, ttl time.Duration) (bool, error)
+
+	// RenewLease extends a lease that ownerID already holds on the shard for
+	// another ttl. It returns an error if ownerID does not currently hold
+	// the lease.
+	RenewLease(stream, shard, ownerID string, ttl time.Duration) error
+
+	// ReleaseShard gives up ownership of the shard before its lease expires,
+	// for example during a graceful shutdown, so another consumer can pick
+	// it up immediately instead of waiting out the lease.
+	ReleaseShard(stream, shard, ownerID string) error
+}
+
+// shardLease tracks who currently owns a shard, and until when.
+type shardLease struct {
+	ownerID   string
+	expiresAt time.Time
 }
 
 // LocalStore implements Store using a local map. This store is not usable
-// if your application is running in multiple containers.
+// if your application is running in multiple containers, since none of them
+// share the map: every process believes it owns every shard. Use DynamoStore
+// or RedisStore if you are running more than one consumer process.
 type LocalStore struct {
-	m     map[string]string
-	mutex sync.Mutex
+	m      map[string]string
+	leases map[string]shardLease
+	mutex  sync.Mutex
 }
 
 // NewLocalStore will create a pointer to a local store that can keep track
-// of our shard iterators.
+// of our shard checkpoints and leases.
 func NewLocalStore() *LocalStore {
 	s := LocalStore{
-		m: make(map[string]string),
+		m:      make(map[string]string),
+		leases: make(map[string]shardLease),
 	}
 
 	return &s
 }
 
 // UpdateShardIterator will use the stream-shard combination as the key, and store
-// the iterator that corresponds to it. Updates require a mutex lock so that two
+// the checkpoint that corresponds to it. Updates require a mutex lock so that two
 // goroutines are not trying to update it at the same time.
 func (s *LocalStore) UpdateShardIterator(stream, shard, iterator string) error {
 	s.mutex.Lock()
@@ -48,9 +77,54 @@ func (s *LocalStore) UpdateShardIterator(stream, shard, iterator string) error {
 	return nil
 }
 
-// GetShardIterator will get the shard iterator that corresponds to the stream-shard
+// GetShardIterator will get the checkpoint that corresponds to the stream-shard
 // combination. We do not require a lock here, because we are simply reading.
 func (s *LocalStore) GetShardIterator(stream, shard string) (string, error) {
 	key := fmt.Sprintf("%s-%s", stream, shard)
 	return s.m[key], nil
 }
+
+// AcquireShard grants ownership of the shard to ownerID if it is unowned, its
+// lease has expired, or ownerID already owns it.
+func (s *LocalStore) AcquireShard(stream, shard, ownerID string, ttl time.Duration) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := fmt.Sprintf("%s-%s", stream, shard)
+	lease, ok := s.leases[key]
+	if ok && lease.ownerID != ownerID && time.Now().Before(lease.expiresAt) {
+		return false, nil
+	}
+
+	s.leases[key] = shardLease{ownerID: ownerID, expiresAt: time.Now().Add(ttl)}
+	return true, nil
+}
+
+// RenewLease extends ownerID's lease on the shard, failing if ownerID does
+// not currently hold it.
+func (s *LocalStore) RenewLease(stream, shard, ownerID string, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := fmt.Sprintf("%s-%s", stream, shard)
+	lease, ok := s.leases[key]
+	if !ok || lease.ownerID != ownerID {
+		return fmt.Errorf("kcl: %s is not owned by %s", key, ownerID)
+	}
+
+	lease.expiresAt = time.Now().Add(ttl)
+	s.leases[key] = lease
+	return nil
+}
+
+// ReleaseShard gives up ownerID's lease on the shard, if it holds one.
+func (s *LocalStore) ReleaseShard(stream, shard, ownerID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := fmt.Sprintf("%s-%s", stream, shard)
+	if lease, ok := s.leases[key]; ok && lease.ownerID == ownerID {
+		delete(s.leases, key)
+	}
+	return nil
+}